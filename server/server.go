@@ -2,22 +2,45 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
 	"io"
 	"log"
 	"mime"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 const (
 	CRLF        = "\r\n"
 	OkStatus    = "200 OK"
 	HTTPVersion = "HTTP/1.1 "
+
+	// idleReadTimeout bounds how long a connection may sit between requests
+	// (or mid-request) before it is dropped.
+	idleReadTimeout = 60 * time.Second
+
+	// chunkEncodeThreshold is the response body size above which the server
+	// sends the body with chunked transfer encoding instead of Content-Length.
+	chunkEncodeThreshold = 1 << 16 // 64 KiB
+	chunkWriteSize       = 1 << 15 // 32 KiB
+
+	// httpTimeFormat is the RFC 7231 preferred date format for Last-Modified
+	// and If-Modified-Since.
+	httpTimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
 )
 
 type HTTPRequest struct {
@@ -28,12 +51,33 @@ type HTTPRequest struct {
 	IsWrongDomain bool
 	BodyLen       int
 	Body          []byte
+	KeepAlive     bool
+	Headers       map[string]string
+}
+
+type headerField struct {
+	name  string
+	value string
 }
 
 type RawResponse struct {
-	body     []byte
+	body     io.Reader
+	bodyLen  int64 // -1 means unknown, forcing chunked transfer encoding
 	mimeType string
 	status   string
+	headers  []headerField
+	closer   io.Closer
+}
+
+// setBody points the response at an in-memory payload.
+func (r *RawResponse) setBody(data []byte) {
+	r.body = bytes.NewReader(data)
+	r.bodyLen = int64(len(data))
+}
+
+// addHeader appends an extra response header, e.g. Content-Range or ETag.
+func (r *RawResponse) addHeader(name, value string) {
+	r.headers = append(r.headers, headerField{name, value})
 }
 
 type HTTPServer struct {
@@ -41,71 +85,247 @@ type HTTPServer struct {
 	socket           net.Listener
 	serverDomain     string
 	workingDirectory string
+
+	connSem    chan struct{}
+	wg         sync.WaitGroup
+	stopCtx    context.Context
+	stopCancel context.CancelFunc
 }
 
+// Serve accepts incoming connections until the listener is closed, dispatching
+// each one to its own goroutine. The number of connections handled at once is
+// bounded by connSem, sized from --max-connections.
+func (s *HTTPServer) Serve() {
+	for {
+		conn, err := s.socket.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Failed to accept connection: %v\n", err)
+			continue
+		}
+
+		s.connSem <- struct{}{}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() { <-s.connSem }()
+			s.handleConnection(conn)
+		}()
+	}
+}
+
+// Shutdown stops accepting new connections, signals in-flight handlers via
+// the server's stop context so they can close their connections promptly,
+// and waits for them to finish, returning early with ctx's error if it is
+// done first.
+func (s *HTTPServer) Shutdown(ctx context.Context) error {
+	s.stopCancel()
+
+	if err := s.socket.Close(); err != nil {
+		fmt.Printf("Error closing listener: %v\n", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handleConnection serves requests off conn one after another, honoring
+// HTTP/1.1 keep-alive, until the client asks to close the connection, the
+// server starts shutting down, the connection goes idle for longer than
+// idleReadTimeout, or it is dropped.
 func (s *HTTPServer) handleConnection(conn net.Conn) {
 	defer conn.Close()
 
 	clientAddress := conn.RemoteAddr().String()
 	fmt.Printf("Handle connection from %s\n", clientAddress)
 
-	req := s.parseRequest(conn)
-	rawResp := s.createRawResponse(req)
-	resp := s.createResponse(*rawResp)
-	s.sendResponse(conn, resp)
+	// Closing conn unblocks a handler parked in a read between keep-alive
+	// requests as soon as Shutdown is called, instead of making it wait out
+	// the idle-read timeout.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-s.stopCtx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	reader := bufio.NewReader(conn)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleReadTimeout))
+
+		req, err := s.parseRequest(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				fmt.Printf("Error parsing request from %s: %v\n", clientAddress, err)
+			}
+			return
+		}
+
+		rawResp := s.createRawResponse(req)
+		s.sendResponse(conn, *rawResp, req.KeepAlive)
+
+		if !req.KeepAlive {
+			return
+		}
+	}
 }
 
 // Parse request to HTTPRequest
-func (s *HTTPServer) parseRequest(conn net.Conn) *HTTPRequest {
+func (s *HTTPServer) parseRequest(reader *bufio.Reader) (*HTTPRequest, error) {
 	req := new(HTTPRequest)
-	reader := bufio.NewReader(conn)
+	req.Headers = make(map[string]string)
+	req.KeepAlive = true
 
-	line, _ := reader.ReadString('\n')
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
 	line = strings.TrimRight(line, CRLF)
 	fmt.Printf("Got line: \"%s\"\n", line)
 
-	splitLine := strings.Split(line, " ")
+	splitLine := strings.SplitN(line, " ", 3)
+	if len(splitLine) < 2 {
+		return nil, fmt.Errorf("malformed request line: %q", line)
+	}
 	req.Type = splitLine[0]
 	req.Dir = splitLine[1]
 
+	lastHeader := ""
 	for {
-		line, _ = reader.ReadString('\n')
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
 		line = strings.TrimRight(line, CRLF)
 
 		if line == "" {
 			break
 		}
 
-		s.parseReqHeader(line, req)
+		// RFC 2616 header folding: a line starting with whitespace continues
+		// the previous header's value.
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && lastHeader != "" {
+			req.Headers[lastHeader] += " " + strings.TrimSpace(line)
+			fmt.Printf("Got line: \"%s\"\n", line)
+			continue
+		}
+
+		name, value, ok := splitHeaderLine(line)
+		if ok {
+			req.Headers[name] = value
+			lastHeader = name
+		}
 
 		fmt.Printf("Got line: \"%s\"\n", line)
 	}
 
-	req.Body = make([]byte, req.BodyLen)
-	_, err := io.ReadFull(reader, req.Body)
-	if err != nil {
-		fmt.Printf("Error while reading body %v\n", err)
+	s.applyHeaders(req)
+
+	if strings.EqualFold(req.Headers["transfer-encoding"], "chunked") {
+		req.Body, err = readChunkedBody(reader)
+		if err != nil {
+			return nil, fmt.Errorf("reading chunked body: %w", err)
+		}
+	} else {
+		req.Body = make([]byte, req.BodyLen)
+		if _, err := io.ReadFull(reader, req.Body); err != nil {
+			fmt.Printf("Error while reading body %v\n", err)
+		}
+	}
+
+	return req, nil
+}
+
+// splitHeaderLine splits a header line into a lower-cased name and trimmed
+// value, tolerating a missing space after the colon.
+func splitHeaderLine(line string) (name, value string, ok bool) {
+	idx := strings.IndexByte(line, ':')
+	if idx < 0 {
+		return "", "", false
 	}
 
-	return req
+	name = strings.ToLower(strings.TrimSpace(line[:idx]))
+	value = strings.TrimSpace(line[idx+1:])
+	return name, value, true
+}
+
+// applyHeaders derives the request's typed fields from the raw, already
+// lower-cased Headers map.
+func (s *HTTPServer) applyHeaders(req *HTTPRequest) {
+	if v, ok := req.Headers["content-length"]; ok {
+		req.BodyLen, _ = strconv.Atoi(v)
+	}
+	if req.Headers["create-directory"] == "True" {
+		req.CreateDir = true
+	}
+	if req.Headers["remove-directory"] == "True" {
+		req.RemoveDir = true
+	}
+	if v, ok := req.Headers["host"]; ok {
+		if s.serverDomain != "" && s.serverDomain != v {
+			req.IsWrongDomain = true
+		}
+	}
+	if v, ok := req.Headers["connection"]; ok {
+		req.KeepAlive = !strings.EqualFold(strings.TrimSpace(v), "close")
+	}
 }
 
-func (s *HTTPServer) parseReqHeader(line string, req *HTTPRequest) {
-	splitLine := strings.SplitN(line, " ", 2) // handling headers
-	switch splitLine[0] {
-	case "Content-Length:":
-		req.BodyLen, _ = strconv.Atoi(splitLine[1])
-	case "Create-Directory:":
-		if splitLine[1] == "True" {
-			req.CreateDir = true
+// readChunkedBody decodes an HTTP/1.1 "Transfer-Encoding: chunked" body,
+// stopping once the terminating zero-length chunk and any trailers are read.
+func readChunkedBody(reader *bufio.Reader) ([]byte, error) {
+	var body []byte
+
+	for {
+		sizeLine, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
 		}
-	case "Remove-Directory:":
-		if splitLine[1] == "True" {
-			req.RemoveDir = true
+		sizeLine = strings.TrimRight(sizeLine, CRLF)
+		sizeLine = strings.SplitN(sizeLine, ";", 2)[0] // drop chunk extensions
+
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeLine), 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chunk size %q: %w", sizeLine, err)
 		}
-	case "Host:":
-		if s.serverDomain != "" && s.serverDomain != splitLine[1] {
-			req.IsWrongDomain = true
+
+		if size == 0 {
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return nil, err
+				}
+				if strings.TrimRight(line, CRLF) == "" {
+					break
+				}
+			}
+			return body, nil
+		}
+
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return nil, err
+		}
+		body = append(body, chunk...)
+
+		if _, err := reader.ReadString('\n'); err != nil { // trailing CRLF after chunk data
+			return nil, err
 		}
 	}
 }
@@ -129,13 +349,14 @@ func (s *HTTPServer) createRawResponse(req *HTTPRequest) (rawResp *RawResponse)
 	case "DELETE":
 		rawResp = s.handleDeleteRequest(req)
 	default:
-		rawResp.body = []byte{}
+		rawResp.setBody(nil)
 	}
 
 	return
 }
 
-func (s *HTTPServer) createResponse(rawResp RawResponse) []byte {
+// createResponseHeader builds the status line and headers for rawResp.
+func (s *HTTPServer) createResponseHeader(rawResp RawResponse, keepAlive, chunked bool) []byte {
 	resp := []byte(HTTPVersion)
 	if rawResp.status == "" {
 		resp = append(resp, []byte(OkStatus)...)
@@ -147,75 +368,519 @@ func (s *HTTPServer) createResponse(rawResp RawResponse) []byte {
 	resp = append(resp, []byte("Server: HWServer")...)
 	resp = append(resp, []byte(CRLF)...)
 
-	resp = append(resp, []byte("Content-Length: ")...)
-	resp = append(resp, []byte(strconv.Itoa(len(rawResp.body)))...)
+	connectionValue := "close"
+	if keepAlive {
+		connectionValue = "keep-alive"
+	}
+	resp = append(resp, []byte("Connection: "+connectionValue)...)
 	resp = append(resp, []byte(CRLF)...)
 
+	if chunked {
+		resp = append(resp, []byte("Transfer-Encoding: chunked")...)
+		resp = append(resp, []byte(CRLF)...)
+	} else {
+		resp = append(resp, []byte("Content-Length: ")...)
+		resp = append(resp, []byte(strconv.FormatInt(rawResp.bodyLen, 10))...)
+		resp = append(resp, []byte(CRLF)...)
+	}
+
 	resp = append(resp, []byte("Content-Type: ")...)
 	resp = append(resp, []byte(rawResp.mimeType)...) // ???
 	resp = append(resp, []byte(CRLF)...)
 
+	for _, h := range rawResp.headers {
+		resp = append(resp, []byte(h.name+": "+h.value)...)
+		resp = append(resp, []byte(CRLF)...)
+	}
+
 	resp = append(resp, []byte(CRLF)...)
-	resp = append(resp, rawResp.body...)
 
 	return resp
 }
 
-func (s *HTTPServer) sendResponse(conn net.Conn, resp []byte) {
-	_, err := conn.Write(resp)
-	if err != nil {
+// chunkedWriter frames every Write call as one HTTP chunk. Close must be
+// called once the body is fully written to emit the terminating chunk.
+type chunkedWriter struct {
+	w io.Writer
+}
+
+func (cw *chunkedWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if _, err := fmt.Fprintf(cw.w, "%x"+CRLF, len(p)); err != nil {
+		return 0, err
+	}
+	if _, err := cw.w.Write(p); err != nil {
+		return 0, err
+	}
+	if _, err := io.WriteString(cw.w, CRLF); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (cw *chunkedWriter) Close() error {
+	_, err := io.WriteString(cw.w, "0"+CRLF+CRLF)
+	return err
+}
+
+// sendResponse writes rawResp's header and streams its body to conn via
+// io.Copy, so large files never need to be buffered whole in memory.
+func (s *HTTPServer) sendResponse(conn net.Conn, rawResp RawResponse, keepAlive bool) {
+	if rawResp.closer != nil {
+		defer rawResp.closer.Close()
+	}
+
+	chunked := rawResp.bodyLen < 0 || rawResp.bodyLen > chunkEncodeThreshold
+
+	header := s.createResponseHeader(rawResp, keepAlive, chunked)
+	if _, err := conn.Write(header); err != nil {
 		fmt.Printf("Error writing response: %v\n", err)
 		return
 	}
 
+	if rawResp.body != nil {
+		var err error
+		if chunked {
+			cw := &chunkedWriter{w: conn}
+			if _, err = io.CopyBuffer(cw, rawResp.body, make([]byte, chunkWriteSize)); err == nil {
+				err = cw.Close()
+			}
+		} else {
+			_, err = io.Copy(conn, rawResp.body)
+		}
+		if err != nil {
+			fmt.Printf("Error writing response body: %v\n", err)
+			return
+		}
+	}
+
 	fmt.Println("Response has sent")
 }
 
+// resolvePath safely joins reqDir onto the server's working directory,
+// rejecting anything that would resolve outside of it: ".." traversal,
+// percent-encoded traversal, symlink escapes, and paths carrying null bytes
+// or control characters. An absolute reqDir is taken relative to the
+// working directory rather than rejected.
+func (s *HTTPServer) resolvePath(reqDir string) (string, error) {
+	decoded, err := url.PathUnescape(reqDir)
+	if err != nil {
+		return "", fmt.Errorf("invalid path encoding: %w", err)
+	}
+
+	if hasDisallowedChars(decoded) {
+		return "", fmt.Errorf("path contains null or control characters")
+	}
+
+	root, err := filepath.Abs(s.workingDirectory)
+	if err != nil {
+		return "", err
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", fmt.Errorf("resolving working directory: %w", err)
+	}
+
+	absolutePath, err := filepath.Abs(filepath.Join(root, decoded))
+	if err != nil {
+		return "", err
+	}
+
+	if !isWithinRoot(root, absolutePath) {
+		return "", fmt.Errorf("path %q escapes the working directory", reqDir)
+	}
+
+	resolved, err := filepath.EvalSymlinks(absolutePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+
+		// The leaf doesn't exist yet (e.g. a POST target), but a symlinked
+		// parent directory could still point outside root. Resolve the
+		// deepest existing ancestor instead and validate that.
+		resolvedAncestor, ancestorErr := resolveExistingAncestor(absolutePath)
+		if ancestorErr != nil {
+			return "", ancestorErr
+		}
+		if !isWithinRoot(root, resolvedAncestor) {
+			return "", fmt.Errorf("path %q escapes the working directory via a symlink", reqDir)
+		}
+
+		return absolutePath, nil
+	}
+
+	if !isWithinRoot(root, resolved) {
+		return "", fmt.Errorf("path %q escapes the working directory via a symlink", reqDir)
+	}
+
+	return absolutePath, nil
+}
+
+// resolveExistingAncestor walks up from path until it finds an ancestor
+// directory that exists, returning that ancestor with its symlinks resolved.
+func resolveExistingAncestor(path string) (string, error) {
+	dir := filepath.Dir(path)
+	for {
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			return resolved, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("no existing ancestor found for %q", path)
+		}
+		dir = parent
+	}
+}
+
+// isWithinRoot reports whether target is root itself or a descendant of it.
+func isWithinRoot(root, target string) bool {
+	rel, err := filepath.Rel(root, target)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (!strings.HasPrefix(rel, ".."+string(filepath.Separator)) && rel != "..")
+}
+
+// hasDisallowedChars reports whether s contains a null byte or a control
+// character, which have no legitimate place in a file path.
+func hasDisallowedChars(s string) bool {
+	for _, r := range s {
+		if r == 0 || r < 0x20 || r == 0x7f {
+			return true
+		}
+	}
+	return false
+}
+
 // Handling requests
 func (s *HTTPServer) handleGetRequest(req *HTTPRequest) (rawResp *RawResponse) {
 	rawResp = new(RawResponse)
-	absolutePath := filepath.Join(s.workingDirectory, req.Dir)
+	absolutePath, err := s.resolvePath(req.Dir)
+	if err != nil {
+		fmt.Printf("Error resolving path %q: %v\n", req.Dir, err)
+		rawResp.status = "403 Forbidden"
+		rawResp.setBody([]byte(fmt.Sprintf("Forbidden: %v", err)))
+		return
+	}
 
 	fi, err := os.Stat(absolutePath)
 	if err != nil {
 		fmt.Printf("Error while getting file %v\n", err)
 		rawResp.status = "404 Not Found"
-		rawResp.body = []byte(fmt.Sprintf("File %s not found", absolutePath))
+		rawResp.setBody([]byte(fmt.Sprintf("File %s not found", absolutePath)))
 		return
 	}
 
 	if fi.Mode().IsDir() {
-		cmd := exec.Command("ls", "-l", "-A", "--time-style=+%Y-%m-%d %H:%M:%S", absolutePath)
-		rawResp.body, err = cmd.Output()
+		// Directory listings link with hrefs relative to the request path;
+		// without a trailing slash the browser resolves them against the
+		// parent directory instead, so redirect to the canonical form first.
+		if !strings.HasSuffix(req.Dir, "/") {
+			rawResp.status = "301 Moved Permanently"
+			rawResp.addHeader("Location", req.Dir+"/")
+			return
+		}
+
+		entries, err := os.ReadDir(absolutePath)
 		if err != nil {
-			fmt.Printf("Error execing command for dir: %v\n", err)
+			fmt.Printf("Error reading directory: %v\n", err)
+			rawResp.status = "500 Internal Server Error"
+			rawResp.setBody([]byte(fmt.Sprintf("Error reading directory %s", absolutePath)))
 			return
 		}
-		//rawResp.body = []byte(strings.SplitN(string(rawResp.body), "\n", 2)[1])
+
+		if acceptsJSON(req) {
+			rawResp.setBody(renderDirectoryJSON(entries))
+			rawResp.mimeType = "application/json"
+		} else {
+			rawResp.setBody(renderDirectoryHTML(req.Dir, entries))
+			rawResp.mimeType = "text/html; charset=utf-8"
+		}
+		return
+	}
+
+	etag := fileETag(fi)
+	rawResp.addHeader("Last-Modified", fi.ModTime().UTC().Format(httpTimeFormat))
+	rawResp.addHeader("ETag", etag)
+
+	if notModified(req, fi, etag) {
+		rawResp.status = "304 Not Modified"
 		return
 	}
 
-	rawResp.body, err = os.ReadFile(absolutePath)
+	file, err := os.Open(absolutePath)
 	if err != nil {
-		fmt.Printf("Error while reading file: %v\n", err)
+		fmt.Printf("Error while opening file: %v\n", err)
+		rawResp.status = "404 Not Found"
+		rawResp.setBody([]byte(fmt.Sprintf("File %s not found", absolutePath)))
 		return
 	}
+	rawResp.closer = file
 
-	rawResp.mimeType = mime.TypeByExtension(filepath.Ext(absolutePath))
-	if rawResp.mimeType == "" {
-		rawResp.mimeType = "application/octet-stream"
+	mimeType, peeked, err := detectContentType(file, filepath.Ext(absolutePath))
+	if err != nil {
+		fmt.Printf("Error sniffing content type: %v\n", err)
+		rawResp.status = "500 Internal Server Error"
+		rawResp.setBody([]byte(fmt.Sprintf("Error reading file %s", absolutePath)))
+		return
+	}
+	rawResp.mimeType = mimeType
+
+	rangeHeader := req.Headers["range"]
+	if rangeHeader == "" {
+		if len(peeked) > 0 {
+			rawResp.body = io.MultiReader(bytes.NewReader(peeked), file)
+		} else {
+			rawResp.body = file
+		}
+		rawResp.bodyLen = fi.Size()
+		return
+	}
+
+	ranges, err := parseByteRanges(rangeHeader, fi.Size())
+	if err != nil {
+		rawResp.status = "416 Range Not Satisfiable"
+		rawResp.addHeader("Content-Range", fmt.Sprintf("bytes */%d", fi.Size()))
+		rawResp.body = nil
+		rawResp.bodyLen = 0
+		return
+	}
+
+	rawResp.status = "206 Partial Content"
+
+	if len(ranges) == 1 {
+		r := ranges[0]
+		rawResp.addHeader("Content-Range", fmt.Sprintf("bytes %d-%d/%d", r.start, r.end, fi.Size()))
+		rawResp.body = io.NewSectionReader(file, r.start, r.end-r.start+1)
+		rawResp.bodyLen = r.end - r.start + 1
+		return
 	}
 
+	rawResp.body, rawResp.mimeType = multipartByterangesBody(file, ranges, rawResp.mimeType, fi.Size())
+	rawResp.bodyLen = -1
 	return
 }
 
+// detectContentType resolves a file's MIME type from its extension, falling
+// back to sniffing the first 512 bytes when the extension is unknown. The
+// sniffed bytes are returned so the caller can prepend them to the body,
+// since reading them advances the file's offset.
+func detectContentType(file *os.File, ext string) (mimeType string, peeked []byte, err error) {
+	if mimeType = mime.TypeByExtension(ext); mimeType != "" {
+		return mimeType, nil, nil
+	}
+
+	buf := make([]byte, 512)
+	n, err := file.Read(buf)
+	if err != nil && err != io.EOF {
+		return "", nil, err
+	}
+
+	return http.DetectContentType(buf[:n]), buf[:n], nil
+}
+
+// acceptsJSON reports whether req asked for a JSON directory listing.
+func acceptsJSON(req *HTTPRequest) bool {
+	return strings.Contains(req.Headers["accept"], "application/json")
+}
+
+type dirEntryJSON struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	IsDir   bool   `json:"isDir"`
+	ModTime string `json:"modTime"`
+}
+
+// renderDirectoryJSON marshals a directory's entries as a JSON array.
+func renderDirectoryJSON(entries []os.DirEntry) []byte {
+	list := make([]dirEntryJSON, 0, len(entries))
+	for _, e := range entries {
+		entry := dirEntryJSON{Name: e.Name(), IsDir: e.IsDir()}
+		if info, err := e.Info(); err == nil {
+			entry.Size = info.Size()
+			entry.ModTime = info.ModTime().UTC().Format(httpTimeFormat)
+		}
+		list = append(list, entry)
+	}
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		fmt.Printf("Error marshaling directory listing: %v\n", err)
+		return []byte("[]")
+	}
+	return data
+}
+
+// renderDirectoryHTML renders a directory's entries as an HTML index with
+// parent-directory navigation.
+func renderDirectoryHTML(reqDir string, entries []os.DirEntry) []byte {
+	var b strings.Builder
+
+	title := html.EscapeString(reqDir)
+	fmt.Fprintf(&b, "<!DOCTYPE html>\n<html>\n<head><meta charset=\"utf-8\"><title>Index of %s</title></head>\n", title)
+	fmt.Fprintf(&b, "<body>\n<h1>Index of %s</h1>\n<ul>\n", title)
+
+	if reqDir != "" && reqDir != "/" {
+		b.WriteString("<li><a href=\"../\">../</a></li>\n")
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		href := name
+		if e.IsDir() {
+			href += "/"
+			name += "/"
+		}
+
+		var size int64
+		var modTime string
+		if info, err := e.Info(); err == nil {
+			size = info.Size()
+			modTime = info.ModTime().UTC().Format(httpTimeFormat)
+		}
+
+		fmt.Fprintf(&b, "<li><a href=\"%s\">%s</a> %d %s</li>\n",
+			html.EscapeString(href), html.EscapeString(name), size, modTime)
+	}
+
+	b.WriteString("</ul>\n</body>\n</html>\n")
+	return []byte(b.String())
+}
+
+// fileETag derives an entity tag from a file's size and modification
+// time, cheap enough to recompute on every request.
+func fileETag(fi os.FileInfo) string {
+	return fmt.Sprintf("%q", fmt.Sprintf("%x-%x", fi.Size(), fi.ModTime().UnixNano()))
+}
+
+// notModified reports whether req's conditional headers are satisfied by the
+// file's current ETag/modification time, meaning 304 Not Modified applies.
+func notModified(req *HTTPRequest, fi os.FileInfo, etag string) bool {
+	if inm := req.Headers["if-none-match"]; inm != "" {
+		return inm == etag || inm == "*"
+	}
+
+	if ims := req.Headers["if-modified-since"]; ims != "" {
+		t, err := time.Parse(httpTimeFormat, ims)
+		if err == nil && !fi.ModTime().Truncate(time.Second).After(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type byteRange struct {
+	start, end int64 // inclusive
+}
+
+// parseByteRanges parses an RFC 7233 "Range: bytes=..." header against a
+// resource of the given size, returning the requested byte ranges in order.
+func parseByteRanges(header string, size int64) ([]byteRange, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return nil, fmt.Errorf("unsupported range unit in %q", header)
+	}
+
+	var ranges []byteRange
+	for _, spec := range strings.Split(header[len(prefix):], ",") {
+		spec = strings.TrimSpace(spec)
+		dash := strings.IndexByte(spec, '-')
+		if dash < 0 {
+			return nil, fmt.Errorf("malformed range %q", spec)
+		}
+
+		startStr, endStr := spec[:dash], spec[dash+1:]
+
+		var r byteRange
+		switch {
+		case startStr == "": // suffix range: "-N" means last N bytes
+			n, err := strconv.ParseInt(endStr, 10, 64)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("malformed suffix range %q", spec)
+			}
+			if n > size {
+				n = size
+			}
+			r = byteRange{start: size - n, end: size - 1}
+		case endStr == "":
+			start, err := strconv.ParseInt(startStr, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("malformed range %q", spec)
+			}
+			r = byteRange{start: start, end: size - 1}
+		default:
+			start, err := strconv.ParseInt(startStr, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("malformed range %q", spec)
+			}
+			end, err := strconv.ParseInt(endStr, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("malformed range %q", spec)
+			}
+			r = byteRange{start: start, end: end}
+		}
+
+		if r.end >= size {
+			r.end = size - 1
+		}
+		if r.start < 0 || r.start > r.end {
+			// This range-spec isn't satisfiable; RFC 7233 §2.1 has the
+			// server ignore it and serve whichever other specs are valid,
+			// only 416-ing if none of them are.
+			continue
+		}
+
+		ranges = append(ranges, r)
+	}
+
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("no satisfiable ranges in %q", header)
+	}
+
+	return ranges, nil
+}
+
+// multipartByterangesBody streams a multipart/byteranges body for a
+// multi-range request: the part headers are held in memory, but each part's
+// file data is read lazily through a section reader.
+func multipartByterangesBody(file *os.File, ranges []byteRange, contentType string, size int64) (io.Reader, string) {
+	boundary := fmt.Sprintf("httpserver-%x-%x", size, len(ranges))
+
+	var readers []io.Reader
+	for _, r := range ranges {
+		part := fmt.Sprintf("--%s"+CRLF+"Content-Type: %s"+CRLF+"Content-Range: bytes %d-%d/%d"+CRLF+CRLF,
+			boundary, contentType, r.start, r.end, size)
+		readers = append(readers, strings.NewReader(part))
+		readers = append(readers, io.NewSectionReader(file, r.start, r.end-r.start+1))
+		readers = append(readers, strings.NewReader(CRLF))
+	}
+	readers = append(readers, strings.NewReader(fmt.Sprintf("--%s--"+CRLF, boundary)))
+
+	return io.MultiReader(readers...), "multipart/byteranges; boundary=" + boundary
+}
+
 func (s *HTTPServer) handlePostRequest(req *HTTPRequest) (rawResp *RawResponse) {
 	rawResp = new(RawResponse)
-	absolutePath := filepath.Join(s.workingDirectory, req.Dir)
+	absolutePath, err := s.resolvePath(req.Dir)
+	if err != nil {
+		fmt.Printf("Error resolving path %q: %v\n", req.Dir, err)
+		rawResp.status = "403 Forbidden"
+		rawResp.setBody([]byte(fmt.Sprintf("Forbidden: %v", err)))
+		return
+	}
 
 	if _, err := os.Stat(absolutePath); err == nil {
 		rawResp.status = "409 Conflict"
-		rawResp.body = []byte(fmt.Sprintf("File %s already exists", absolutePath))
+		rawResp.setBody([]byte(fmt.Sprintf("File %s already exists", absolutePath)))
 		return
 	}
 
@@ -227,7 +892,7 @@ func (s *HTTPServer) handlePostRequest(req *HTTPRequest) (rawResp *RawResponse)
 		return
 	}
 
-	err := os.WriteFile(absolutePath, req.Body, os.ModePerm)
+	err = os.WriteFile(absolutePath, req.Body, os.ModePerm)
 	if err != nil {
 		fmt.Printf("Error while creting file or writing to file: %v\n", err)
 	}
@@ -237,19 +902,25 @@ func (s *HTTPServer) handlePostRequest(req *HTTPRequest) (rawResp *RawResponse)
 
 func (s *HTTPServer) handlePutRequest(req *HTTPRequest) (rawResp *RawResponse) {
 	rawResp = new(RawResponse)
-	absolutePath := filepath.Join(s.workingDirectory, req.Dir)
+	absolutePath, err := s.resolvePath(req.Dir)
+	if err != nil {
+		fmt.Printf("Error resolving path %q: %v\n", req.Dir, err)
+		rawResp.status = "403 Forbidden"
+		rawResp.setBody([]byte(fmt.Sprintf("Forbidden: %v", err)))
+		return
+	}
 
 	fi, err := os.Stat(absolutePath)
 	if err != nil {
 		fmt.Printf("Error while putting file %v\n", err)
 		rawResp.status = "404 Not Found"
-		rawResp.body = []byte(fmt.Sprintf("File %s not found", absolutePath))
+		rawResp.setBody([]byte(fmt.Sprintf("File %s not found", absolutePath)))
 		return
 	}
 
 	if fi.Mode().IsDir() {
 		rawResp.status = "409 Conflict"
-		rawResp.body = []byte(fmt.Sprintf("File %s is a directory", absolutePath))
+		rawResp.setBody([]byte(fmt.Sprintf("File %s is a directory", absolutePath)))
 		return
 	}
 
@@ -263,20 +934,26 @@ func (s *HTTPServer) handlePutRequest(req *HTTPRequest) (rawResp *RawResponse) {
 
 func (s *HTTPServer) handleDeleteRequest(req *HTTPRequest) (rawResp *RawResponse) {
 	rawResp = new(RawResponse)
-	absolutePath := filepath.Join(s.workingDirectory, req.Dir)
+	absolutePath, err := s.resolvePath(req.Dir)
+	if err != nil {
+		fmt.Printf("Error resolving path %q: %v\n", req.Dir, err)
+		rawResp.status = "403 Forbidden"
+		rawResp.setBody([]byte(fmt.Sprintf("Forbidden: %v", err)))
+		return
+	}
 
 	fi, err := os.Stat(absolutePath)
 	if err != nil {
 		fmt.Printf("Error while putting file %v\n", err)
 		rawResp.status = "404 Not Found"
-		rawResp.body = []byte(fmt.Sprintf("File %s not found", absolutePath))
+		rawResp.setBody([]byte(fmt.Sprintf("File %s not found", absolutePath)))
 		return
 	}
 
 	if fi.Mode().IsDir() {
 		if !req.RemoveDir {
 			rawResp.status = "406 Not Acceptable"
-			rawResp.body = []byte(fmt.Sprintf("File %s is a directory", absolutePath))
+			rawResp.setBody([]byte(fmt.Sprintf("File %s is a directory", absolutePath)))
 			return
 		}
 
@@ -299,7 +976,7 @@ func (s *HTTPServer) handleDeleteRequest(req *HTTPRequest) (rawResp *RawResponse
 }
 
 func main() {
-	var host, port, serverDomain, workingDirectory string
+	var host, port, serverDomain, workingDirectory, maxConnections string
 	// from args
 	for i := 1; i < len(os.Args); i++ {
 		arg := strings.SplitN(os.Args[i], "=", 2)
@@ -312,6 +989,8 @@ func main() {
 			workingDirectory = arg[1]
 		case "--server-domain":
 			serverDomain = arg[1]
+		case "--max-connections":
+			maxConnections = arg[1]
 		default:
 			log.Fatalf("Unknown argument: %s\n", os.Args[i])
 		}
@@ -329,6 +1008,9 @@ func main() {
 	if workingDirectory == "" {
 		workingDirectory = os.Getenv("SERVER_WORKING_DIRECTORY")
 	}
+	if maxConnections == "" {
+		maxConnections = os.Getenv("SERVER_MAX_CONNECTIONS")
+	}
 	// default
 	if host == "" {
 		host = "0.0.0.0"
@@ -339,6 +1021,14 @@ func main() {
 	if workingDirectory == "" {
 		log.Fatalf("No argument \"working directory\" got\n")
 	}
+	maxConnectionsNum := 100
+	if maxConnections != "" {
+		var err error
+		maxConnectionsNum, err = strconv.Atoi(maxConnections)
+		if err != nil || maxConnectionsNum <= 0 {
+			log.Fatalf("Invalid \"max connections\" value: %s\n", maxConnections)
+		}
+	}
 
 	serverAddress := fmt.Sprintf("%s:%s", host, port)
 
@@ -350,22 +1040,34 @@ func main() {
 	}
 	defer serverSocket.Close()
 
+	stopCtx, stopCancel := context.WithCancel(context.Background())
+
 	server := &HTTPServer{
 		serverAddress:    serverAddress,
 		socket:           serverSocket,
 		serverDomain:     serverDomain,
 		workingDirectory: workingDirectory,
+		connSem:          make(chan struct{}, maxConnectionsNum),
+		stopCtx:          stopCtx,
+		stopCancel:       stopCancel,
 	}
 
 	fmt.Printf("Listening at %s\n", serverAddress)
 
-	for {
-		conn, err := serverSocket.Accept()
-		if err != nil {
-			log.Printf("Failed to accept connection: %v\n", err)
-			continue
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		fmt.Printf("Got signal %v, shutting down\n", sig)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Shutdown finished with error: %v\n", err)
 		}
+	}()
 
-		server.handleConnection(conn)
-	}
+	server.Serve()
+	fmt.Println("Server stopped")
 }
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestServer(t *testing.T) (*HTTPServer, string) {
+	t.Helper()
+	root := t.TempDir()
+	return &HTTPServer{workingDirectory: root}, root
+}
+
+func TestResolvePathAllowsSymlinkedWorkingDirectory(t *testing.T) {
+	realRoot := t.TempDir()
+	if err := os.WriteFile(filepath.Join(realRoot, "file.txt"), []byte("ok"), 0o644); err != nil {
+		t.Fatalf("failed to write fixture file: %v", err)
+	}
+
+	symRoot := filepath.Join(t.TempDir(), "served")
+	if err := os.Symlink(realRoot, symRoot); err != nil {
+		t.Fatalf("failed to create symlink: %v", err)
+	}
+
+	s := &HTTPServer{workingDirectory: symRoot}
+
+	if _, err := s.resolvePath("file.txt"); err != nil {
+		t.Fatalf("unexpected error for file inside a symlinked working directory: %v", err)
+	}
+
+	if _, err := s.resolvePath(""); err != nil {
+		t.Fatalf("unexpected error listing a symlinked working directory itself: %v", err)
+	}
+}
+
+func TestResolvePathRejectsParentTraversal(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	if got, err := s.resolvePath("../etc/passwd"); err == nil {
+		t.Fatalf("expected error for \"..\" traversal, got %q", got)
+	}
+}
+
+func TestResolvePathContainsAbsoluteLookingPath(t *testing.T) {
+	s, root := newTestServer(t)
+
+	got, err := s.resolvePath("/etc/passwd")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !isWithinRoot(root, got) {
+		t.Fatalf("resolvePath(%q) = %q, escapes root %q", "/etc/passwd", got, root)
+	}
+}
+
+func TestResolvePathRejectsEncodedTraversal(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	if got, err := s.resolvePath("%2e%2e/%2e%2e/etc/passwd"); err == nil {
+		t.Fatalf("expected error for encoded \"..\" traversal, got %q", got)
+	}
+}
+
+func TestResolvePathAllowsDescendant(t *testing.T) {
+	s, root := newTestServer(t)
+
+	if err := os.WriteFile(filepath.Join(root, "file.txt"), []byte("ok"), 0o644); err != nil {
+		t.Fatalf("failed to write fixture file: %v", err)
+	}
+
+	got, err := s.resolvePath("file.txt")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := filepath.Join(root, "file.txt")
+	if got != want {
+		t.Fatalf("resolvePath(%q) = %q, want %q", "file.txt", got, want)
+	}
+}
+
+func TestResolvePathRejectsSymlinkEscape(t *testing.T) {
+	s, root := newTestServer(t)
+	outside := t.TempDir()
+
+	target := filepath.Join(outside, "secret.txt")
+	if err := os.WriteFile(target, []byte("secret"), 0o644); err != nil {
+		t.Fatalf("failed to write fixture file: %v", err)
+	}
+
+	link := filepath.Join(root, "escape")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatalf("failed to create symlink: %v", err)
+	}
+
+	if got, err := s.resolvePath("escape"); err == nil {
+		t.Fatalf("expected error for symlink escape, got %q", got)
+	}
+}
+
+func TestResolvePathRejectsSymlinkedParentWithMissingLeaf(t *testing.T) {
+	s, root := newTestServer(t)
+	outside := t.TempDir()
+
+	link := filepath.Join(root, "evil")
+	if err := os.Symlink(outside, link); err != nil {
+		t.Fatalf("failed to create symlink: %v", err)
+	}
+
+	if got, err := s.resolvePath("evil/newfile.txt"); err == nil {
+		t.Fatalf("expected error for symlinked parent escape, got %q", got)
+	}
+}
+
+func TestResolvePathRejectsControlCharacters(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	if got, err := s.resolvePath("file\x00.txt"); err == nil {
+		t.Fatalf("expected error for null byte in path, got %q", got)
+	}
+}
+
+func TestParseByteRangesServesSatisfiableSpecsWhenOthersArent(t *testing.T) {
+	const size = 11 // bytes 0-10
+
+	ranges, err := parseByteRanges("bytes=0-10,99999-100000", size)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []byteRange{{start: 0, end: 10}}
+	if len(ranges) != len(want) || ranges[0] != want[0] {
+		t.Fatalf("parseByteRanges() = %+v, want %+v", ranges, want)
+	}
+}
+
+func TestParseByteRangesRejectsWhenNoneSatisfiable(t *testing.T) {
+	if ranges, err := parseByteRanges("bytes=99999-100000", 11); err == nil {
+		t.Fatalf("expected error when no range-spec is satisfiable, got %+v", ranges)
+	}
+}
+
+func TestParseByteRangesClampsEndBeyondSize(t *testing.T) {
+	ranges, err := parseByteRanges("bytes=5-100000", 11)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := byteRange{start: 5, end: 10}
+	if len(ranges) != 1 || ranges[0] != want {
+		t.Fatalf("parseByteRanges() = %+v, want [%+v]", ranges, want)
+	}
+}